@@ -0,0 +1,51 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/writers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/accounts"
+	"github.com/matrix-org/dendrite/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// SetupMembershipRoutes adds the /invite, /join, /leave, /kick, /ban and
+// /unban endpoints to apiMux. The main client-API Setup does not call it.
+func SetupMembershipRoutes(
+	apiMux *mux.Router, cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) {
+	register := func(action string, handler func(*http.Request, *authtypes.Device, string, *config.Dendrite, *accounts.Database, api.RoomserverInputAPI) util.JSONResponse) {
+		apiMux.Handle("/rooms/{roomID}/"+action,
+			common.MakeAuthAPI(action, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+				vars := mux.Vars(req)
+				return handler(req, device, vars["roomID"], cfg, accountDB, producer)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	register("invite", writers.Invite)
+	register("join", writers.Join)
+	register("leave", writers.Leave)
+	register("kick", writers.Kick)
+	register("ban", writers.Ban)
+	register("unban", writers.Unban)
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/authtypes"
+	"github.com/matrix-org/dendrite/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// BuildEvent fills in the fields that every client-initiated event needs -
+// origin_server_ts, sender, room_id, type and, for state events, state_key -
+// signs it with this homeserver's key, and returns it ready to be passed to
+// RoomserverInputAPI.InputRoomEvents. The caller is responsible for setting
+// the event content and any other builder fields before calling this.
+//
+// membership.go calls it to build m.room.member events. sendevent.go's
+// PUT /rooms/{roomID}/send/{eventType} handler does not call it.
+func BuildEvent(
+	builder *gomatrixserverlib.EventBuilder,
+	cfg *config.Dendrite,
+	device *authtypes.Device,
+	roomID, eventType string,
+	stateKey *string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	builder.Type = eventType
+	builder.RoomID = roomID
+	builder.Sender = device.UserID
+	builder.StateKey = stateKey
+
+	event, err := builder.Build(
+		time.Now(), cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	headeredEvent := event.Headered(cfg.Matrix.RoomVersions.Default)
+	return &headeredEvent, nil
+}
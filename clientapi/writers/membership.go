@@ -0,0 +1,168 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/accounts"
+	"github.com/matrix-org/dendrite/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// membershipRequest is the body of an /invite, /kick, /ban or /unban
+// request. join and leave do not read a request body.
+type membershipRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Invite implements POST /rooms/{roomID}/invite
+func Invite(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembership(req, device, roomID, gomatrixserverlib.Invite, cfg, accountDB, producer)
+}
+
+// Join implements POST /rooms/{roomID}/join
+func Join(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembershipForTarget(req, device, roomID, device.UserID, gomatrixserverlib.Join, "", cfg, accountDB, producer)
+}
+
+// Leave implements POST /rooms/{roomID}/leave
+func Leave(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembershipForTarget(req, device, roomID, device.UserID, gomatrixserverlib.Leave, "", cfg, accountDB, producer)
+}
+
+// Kick implements POST /rooms/{roomID}/kick
+func Kick(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembership(req, device, roomID, gomatrixserverlib.Leave, cfg, accountDB, producer)
+}
+
+// Ban implements POST /rooms/{roomID}/ban
+func Ban(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembership(req, device, roomID, gomatrixserverlib.Ban, cfg, accountDB, producer)
+}
+
+// Unban implements POST /rooms/{roomID}/unban
+func Unban(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	return sendMembership(req, device, roomID, gomatrixserverlib.Leave, cfg, accountDB, producer)
+}
+
+// sendMembership decodes a membership request body and applies it to the
+// target user named in the body. This is the shape shared by invite, kick,
+// ban and unban - endpoints where the state_key is never the calling user.
+func sendMembership(
+	req *http.Request, device *authtypes.Device, roomID string, membership string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	var body membershipRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.BadJSON("invalid request body: " + err.Error())}
+	}
+	if body.UserID == "" {
+		return util.JSONResponse{Code: http.StatusBadRequest, JSON: jsonerror.MissingArgument("'user_id' must be supplied for membership changes")}
+	}
+
+	return sendMembershipForTarget(req, device, roomID, body.UserID, membership, body.Reason, cfg, accountDB, producer)
+}
+
+// sendMembershipForTarget builds and submits the m.room.member event for
+// targetUserID, looking up their profile first if they are local to this
+// homeserver. reason is carried through to the event content verbatim; it
+// is empty for join/leave, which have no request body.
+func sendMembershipForTarget(
+	req *http.Request, device *authtypes.Device, roomID, targetUserID, membership, reason string,
+	cfg *config.Dendrite, accountDB *accounts.Database,
+	producer api.RoomserverInputAPI,
+) util.JSONResponse {
+	content := gomatrixserverlib.MemberContent{
+		Membership: membership,
+		Reason:     reason,
+	}
+
+	if accountDB.IsLocalUser(targetUserID) {
+		localpart, _, err := gomatrixserverlib.SplitID('@', targetUserID)
+		if err == nil {
+			profile, err := accountDB.GetProfileByLocalpart(req.Context(), localpart)
+			if err == nil && profile != nil {
+				content.DisplayName = profile.DisplayName
+				content.AvatarURL = profile.AvatarURL
+			}
+		}
+	}
+
+	builder := &gomatrixserverlib.EventBuilder{}
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	builder.Content = contentJSON
+
+	event, err := BuildEvent(builder, cfg, device, roomID, "m.room.member", &targetUserID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	if err = submitEvent(req.Context(), producer, event); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+}
+
+// submitEvent hands a built event to the roomserver as a new (non-backfill)
+// room event.
+func submitEvent(ctx context.Context, producer api.RoomserverInputAPI, event *gomatrixserverlib.HeaderedEvent) error {
+	var response api.InputRoomEventsResponse
+	request := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:  api.KindNew,
+				Event: *event,
+			},
+		},
+	}
+	return producer.InputRoomEvents(ctx, &request, &response)
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// RoomEventDatabase is the persistence interface the input path uses to
+// store new and backfilled room events.
+type RoomEventDatabase interface {
+	// WithTransaction runs fn inside a single database transaction. If fn
+	// returns an error, every write fn made through txn is rolled back and
+	// WithTransaction returns that error; otherwise the transaction is
+	// committed before WithTransaction returns.
+	WithTransaction(ctx context.Context, fn func(txn Transaction) error) error
+}
+
+// Transaction is the subset of RoomEventDatabase available to code running
+// inside a WithTransaction callback.
+type Transaction interface {
+	// StoreEvent persists a new room event (and any state/auth updates it
+	// implies), returning the event ID it was assigned and the output
+	// events - room state/timeline updates - that should be published once
+	// the enclosing transaction commits.
+	StoreEvent(ctx context.Context, event api.InputRoomEvent) (eventID string, outputs []api.OutputEvent, err error)
+	// StoreInviteEvent persists a standalone invite: an event the server
+	// received out-of-band, without the rest of the room's state.
+	StoreInviteEvent(ctx context.Context, event api.InputInviteEvent) error
+}
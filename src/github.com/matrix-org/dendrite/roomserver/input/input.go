@@ -18,63 +18,172 @@ package input
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
-	"github.com/opentracing/opentracing-go"
-
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
 // RoomserverInputAPI implements api.RoomserverInputAPI
 type RoomserverInputAPI struct {
-	DB       RoomEventDatabase
-	Producer sarama.SyncProducer
-	// The kafkaesque topic to output new room events to.
-	// This is the name used in kafka to identify the stream to write events to.
-	OutputRoomEventTopic string
+	DB RoomEventDatabase
+	// OutputEventPublisher carries newly-written output events to consumers.
+	// Use NewRoomserverInputAPI to pick the right implementation from config
+	// rather than setting this directly.
+	OutputEventPublisher OutputEventPublisher
+	// txnCache de-duplicates retried InputRoomEvents calls that carry a
+	// TransactionID, so clients can safely retry on network errors.
+	txnCache *transactionCache
+}
+
+// NewRoomserverInputAPI creates a RoomserverInputAPI, choosing an
+// OutputEventPublisher according to cfg.RoomServer.Output.Transport
+// ("kafka" or "nats").
+func NewRoomserverInputAPI(
+	db RoomEventDatabase, cfg *config.Dendrite,
+	kafkaProducer sarama.SyncProducer, natsJS nats.JetStreamContext,
+) (*RoomserverInputAPI, error) {
+	var publisher OutputEventPublisher
+	switch cfg.RoomServer.Output.Transport {
+	case "nats":
+		publisher = NewNATSPublisher(natsJS, cfg.RoomServer.Output.NATSSubjectPrefix)
+	case "kafka", "":
+		publisher = NewKafkaPublisher(kafkaProducer, cfg.RoomServer.Output.KafkaTopic)
+	default:
+		return nil, fmt.Errorf("unknown output.transport %q", cfg.RoomServer.Output.Transport)
+	}
+	return &RoomserverInputAPI{DB: db, OutputEventPublisher: publisher, txnCache: newTransactionCache()}, nil
 }
 
 // WriteOutputEvents implements OutputRoomEventWriter
 func (r *RoomserverInputAPI) WriteOutputEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
-	messages := make([]*sarama.ProducerMessage, len(updates))
 	for i := range updates {
 		value, err := json.Marshal(updates[i])
 		if err != nil {
 			return err
 		}
-		msg := &sarama.ProducerMessage{
-			Topic: r.OutputRoomEventTopic,
-			Key:   sarama.StringEncoder(roomID),
-			Value: sarama.ByteEncoder(value),
+		if err = r.OutputEventPublisher.Publish(ctx, roomID, string(value)); err != nil {
+			return err
 		}
-		common.SerialiseOpentracingSpan(opentracing.GlobalTracer(), ctx, msg)
-		messages[i] = msg
 	}
-	return r.Producer.SendMessages(messages)
+	return nil
 }
 
 // InputRoomEvents implements api.RoomserverInputAPI
+//
+// If request.TransactionID is set and we have already processed that
+// (device ID, transaction ID) pair, the previously-computed response is
+// returned without touching the database again. Otherwise the whole batch
+// is processed inside a single database transaction, so a failure partway
+// through rolls back every state and output write in the batch; output
+// events are only published to the transport once that transaction commits.
+// Every event in the batch is still attempted and gets its own
+// response.Results entry (EventID, Error) regardless of whether an earlier
+// event in the same batch failed, so a caller can tell exactly which
+// events to retry instead of having to resubmit the whole batch blind.
+// When any event fails, events that succeeded on their own were rolled
+// back with the batch and their entries carry an error saying so.
 func (r *RoomserverInputAPI) InputRoomEvents(
 	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) error {
-	for i := range request.InputRoomEvents {
-		if err := processRoomEvent(ctx, r.DB, r, request.InputRoomEvents[i]); err != nil {
-			return err
+	var txnKey string
+	if request.TransactionID != nil {
+		txnKey = transactionCacheKey(request.TransactionID.DeviceID, request.TransactionID.TransactionID)
+		if cached, ok := r.txnCache.fetch(txnKey); ok {
+			*response = cached
+			return nil
+		}
+	}
+
+	var pendingOutputs map[string][]api.OutputEvent
+	txnErr := r.DB.WithTransaction(ctx, func(txn Transaction) error {
+		pendingOutputs = make(map[string][]api.OutputEvent)
+		response.Results = make([]api.InputRoomEventResult, 0, len(request.InputRoomEvents))
+
+		var firstErr error
+		for i := range request.InputRoomEvents {
+			input := request.InputRoomEvents[i]
+			eventID, outputs, err := processRoomEventTxn(ctx, txn, r, input)
+			response.Results = append(response.Results, api.InputRoomEventResult{
+				EventID: eventID,
+				Error:   errString(err),
+			})
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			pendingOutputs[input.Event.RoomID()] = append(pendingOutputs[input.Event.RoomID()], outputs...)
 		}
+		for i := range request.InputInviteEvents {
+			if err := processInviteEventTxn(ctx, txn, r, request.InputInviteEvents[i]); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return &partialBatchFailure{err: firstErr}
+		}
+		return nil
+	})
+	if txnErr != nil {
+		var partial *partialBatchFailure
+		if errors.As(txnErr, &partial) {
+			// response.Results was filled in above before the rollback.
+			// The rollback also undid the events that succeeded, so mark
+			// those as not stored; the caller then has everything it needs
+			// to retry the events that failed, and the call itself is
+			// reported as successful instead of masking that detail behind
+			// a generic error.
+			for i := range response.Results {
+				if response.Results[i].Error == "" {
+					response.Results[i].Error = "not stored: batch rolled back: " + partial.Error()
+				}
+			}
+			return nil
+		}
+		return txnErr
 	}
-	for i := range request.InputInviteEvents {
-		if err := processInviteEvent(ctx, r.DB, r, request.InputInviteEvents[i]); err != nil {
+
+	for roomID, outputs := range pendingOutputs {
+		if err := r.WriteOutputEvents(ctx, roomID, outputs); err != nil {
 			return err
 		}
 	}
+
+	if txnKey != "" {
+		r.txnCache.store(txnKey, *response)
+	}
 	return nil
 }
 
+// partialBatchFailure wraps the first per-event error encountered while
+// processing a batch, so InputRoomEvents can tell "the transaction rolled
+// back because one of the events in it failed" (expected, recoverable via
+// response.Results) apart from an infrastructure error such as the
+// transaction failing to begin or commit at all.
+type partialBatchFailure struct{ err error }
+
+func (p *partialBatchFailure) Error() string { return p.err.Error() }
+func (p *partialBatchFailure) Unwrap() error { return p.err }
+
+// errString turns err into the string carried in an InputRoomEventResult,
+// leaving it empty when there was no error.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
 // SetupHTTP adds the RoomserverInputAPI handlers to the http.ServeMux.
 func (r *RoomserverInputAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(api.RoomserverInputRoomEventsPath,
@@ -0,0 +1,38 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// processRoomEventTxn stores a single new room event through txn and
+// reports the output events it produced, so the caller can publish them
+// once the whole batch's transaction has committed.
+func processRoomEventTxn(
+	ctx context.Context, txn Transaction, r *RoomserverInputAPI, input api.InputRoomEvent,
+) (eventID string, outputs []api.OutputEvent, err error) {
+	return txn.StoreEvent(ctx, input)
+}
+
+// processInviteEventTxn stores a single standalone invite event through
+// txn.
+func processInviteEventTxn(
+	ctx context.Context, txn Transaction, r *RoomserverInputAPI, input api.InputInviteEvent,
+) error {
+	return txn.StoreInviteEvent(ctx, input)
+}
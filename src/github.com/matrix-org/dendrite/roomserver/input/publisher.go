@@ -0,0 +1,90 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputEventPublisher hides the wire transport used to fan output room
+// events out to consumers (syncapi, federationsender, etc) behind a single
+// method, so RoomserverInputAPI doesn't need to know whether it is talking
+// to Kafka or NATS JetStream. The Kafka implementation carries the calling
+// opentracing span across the wire in the message; the NATS implementation
+// does not carry it.
+type OutputEventPublisher interface {
+	// Publish sends value, keyed by key (the room ID, so that all updates
+	// for a room are delivered in order).
+	Publish(ctx context.Context, key, value string) error
+}
+
+// kafkaPublisher is the original OutputEventPublisher, backed by a sarama
+// sync producer.
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewKafkaPublisher creates an OutputEventPublisher that publishes output
+// room events to the given Kafka topic.
+func NewKafkaPublisher(producer sarama.SyncProducer, topic string) OutputEventPublisher {
+	return &kafkaPublisher{producer: producer, topic: topic}
+}
+
+func (k *kafkaPublisher) Publish(ctx context.Context, key, value string) error {
+	msg := &sarama.ProducerMessage{
+		Topic: k.topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.StringEncoder(value),
+	}
+	common.SerialiseOpentracingSpan(opentracing.GlobalTracer(), ctx, msg)
+	_, _, err := k.producer.SendMessage(msg)
+	return err
+}
+
+// natsPublisher is an OutputEventPublisher backed by a NATS JetStream
+// stream. Each room is published to its own subject so that JetStream's
+// per-subject ordering guarantees give us per-room ordering for free.
+type natsPublisher struct {
+	js            nats.JetStreamContext
+	subjectPrefix string
+}
+
+// NewNATSPublisher creates an OutputEventPublisher that publishes output
+// room events to a per-room subject of the form "<subjectPrefix>.<roomID>"
+// on the given JetStream context. The stream backing subjectPrefix must
+// already exist (or be configured with wildcard subjects covering it).
+func NewNATSPublisher(js nats.JetStreamContext, subjectPrefix string) OutputEventPublisher {
+	return &natsPublisher{js: js, subjectPrefix: subjectPrefix}
+}
+
+func (n *natsPublisher) Publish(ctx context.Context, key, value string) error {
+	msg := nats.NewMsg(natsSubject(n.subjectPrefix, key))
+	msg.Data = []byte(value)
+	_, err := n.js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+// natsSubject builds the per-room JetStream subject a message is published
+// to, so that JetStream's per-subject ordering gives us per-room ordering.
+func natsSubject(subjectPrefix, roomID string) string {
+	return fmt.Sprintf("%s.%s", subjectPrefix, roomID)
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import "testing"
+
+func TestNATSSubjectIsPerRoom(t *testing.T) {
+	got := natsSubject("roomserver.output", "!abc:example.com")
+	want := "roomserver.output.!abc:example.com"
+	if got != want {
+		t.Errorf("natsSubject() = %q, want %q", got, want)
+	}
+
+	other := natsSubject("roomserver.output", "!xyz:example.com")
+	if got == other {
+		t.Errorf("natsSubject() produced the same subject for two different rooms: %q", got)
+	}
+}
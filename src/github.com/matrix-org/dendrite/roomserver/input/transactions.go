@@ -0,0 +1,91 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// transactionCacheSize bounds how many outstanding (device_id, txn_id) pairs
+// we remember. It only needs to cover the window a client might plausibly
+// retry a request in, not its whole lifetime.
+const transactionCacheSize = 30000
+
+// transactionCache remembers the InputRoomEventsResponse produced for a
+// given (device_id, txn_id) pair so that a client retrying a request after
+// a network error gets back the original result instead of creating
+// duplicate events.
+type transactionCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front = most recently used
+}
+
+type transactionCacheEntry struct {
+	key      string
+	response api.InputRoomEventsResponse
+}
+
+func newTransactionCache() *transactionCache {
+	return &transactionCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func transactionCacheKey(deviceID, txnID string) string {
+	return deviceID + "\x00" + txnID
+}
+
+// fetch returns the cached response for key, if any, and promotes it to
+// most-recently-used.
+func (c *transactionCache) fetch(key string) (api.InputRoomEventsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return api.InputRoomEventsResponse{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*transactionCacheEntry).response, true
+}
+
+// store records response under key, evicting the least-recently-used entry
+// if the cache is full.
+func (c *transactionCache) store(key string, response api.InputRoomEventsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*transactionCacheEntry).response = response
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(&transactionCacheEntry{key: key, response: response})
+	c.entries[key] = elem
+
+	if c.order.Len() > transactionCacheSize {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*transactionCacheEntry).key)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func TestTransactionCacheFetchStore(t *testing.T) {
+	c := newTransactionCache()
+	key := transactionCacheKey("device1", "txn1")
+
+	if _, ok := c.fetch(key); ok {
+		t.Fatalf("fetch() on empty cache returned a hit")
+	}
+
+	want := api.InputRoomEventsResponse{Results: []api.InputRoomEventResult{{EventID: "$1"}}}
+	c.store(key, want)
+
+	got, ok := c.fetch(key)
+	if !ok {
+		t.Fatalf("fetch() after store() returned a miss")
+	}
+	if len(got.Results) != 1 || got.Results[0].EventID != "$1" {
+		t.Fatalf("fetch() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTransactionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTransactionCache()
+
+	for i := 0; i < transactionCacheSize; i++ {
+		key := transactionCacheKey("device1", fmt.Sprintf("txn%d", i))
+		c.store(key, api.InputRoomEventsResponse{})
+	}
+
+	// Touch the first entry so it isn't the least-recently-used one.
+	firstKey := transactionCacheKey("device1", "txn0")
+	if _, ok := c.fetch(firstKey); !ok {
+		t.Fatalf("fetch() of first entry returned a miss before eviction")
+	}
+
+	// Inserting one more entry should evict the least-recently-used entry
+	// (txn1, since txn0 was just touched), not txn0.
+	overflowKey := transactionCacheKey("device1", "overflow")
+	c.store(overflowKey, api.InputRoomEventsResponse{})
+
+	if _, ok := c.fetch(firstKey); !ok {
+		t.Errorf("fetch() of recently-used entry returned a miss after eviction")
+	}
+
+	evictedKey := transactionCacheKey("device1", "txn1")
+	if _, ok := c.fetch(evictedKey); ok {
+		t.Errorf("fetch() of least-recently-used entry returned a hit after eviction")
+	}
+
+	if c.order.Len() != transactionCacheSize {
+		t.Errorf("cache size = %d, want %d", c.order.Len(), transactionCacheSize)
+	}
+}
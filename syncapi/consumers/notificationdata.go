@@ -0,0 +1,166 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/pushrules"
+	log "github.com/sirupsen/logrus"
+)
+
+// NotificationDataConsumer reads the roomserver's output topic and keeps
+// syncapi_notification_data up to date, so that /sync can report
+// unread_notifications without evaluating push rules on every request.
+//
+// It is idempotent: each row already records the stream position of the
+// update that produced it (see IncrementCounts in storage/shared), so replaying a message
+// after a restart is a no-op rather than double-counting.
+type NotificationDataConsumer struct {
+	rsAPI   api.RoomserverQueryAPI
+	db      storage.Database
+	userAPI UserRoomMembersAPI
+}
+
+// UserRoomMembersAPI is the subset of the userapi/roomserver surface this
+// consumer needs: the set of local users who should have their push rules
+// evaluated for a given room, and each of their current account push rules.
+type UserRoomMembersAPI interface {
+	LocalUsersInRoom(ctx context.Context, roomID string) ([]string, error)
+	PushRulesForUser(ctx context.Context, userID string) (*pushrules.AccountRuleSet, error)
+}
+
+// NewNotificationDataConsumer creates a consumer ready to have OnMessage
+// called for each message read off the roomserver output topic.
+func NewNotificationDataConsumer(
+	rsAPI api.RoomserverQueryAPI, db storage.Database, userAPI UserRoomMembersAPI,
+) *NotificationDataConsumer {
+	return &NotificationDataConsumer{rsAPI: rsAPI, db: db, userAPI: userAPI}
+}
+
+// OnMessage is called once per roomserver output event. It evaluates push
+// rules for every local user in the room and, for m.read/m.fully_read
+// receipts, resets that user's counts for the room instead.
+func (c *NotificationDataConsumer) OnMessage(ctx context.Context, msg []byte) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg, &output); err != nil {
+		log.WithError(err).Error("notificationdata consumer: failed to unmarshal output event")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+
+	event := output.NewRoomEvent.Event
+	switch event.Type() {
+	case "m.receipt":
+		return c.processReceipt(ctx, event)
+	default:
+		pos, err := c.db.StreamPositionForEvent(ctx, event.EventID())
+		if err != nil {
+			return err
+		}
+		return c.processTimelineEvent(ctx, event, pos)
+	}
+}
+
+func (c *NotificationDataConsumer) processTimelineEvent(
+	ctx context.Context, event gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) error {
+	members, err := c.userAPI.LocalUsersInRoom(ctx, event.RoomID())
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range members {
+		if userID == event.Sender() {
+			continue // never notify a user about their own event
+		}
+
+		rules, err := c.userAPI.PushRulesForUser(ctx, userID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("notificationdata consumer: failed to load push rules")
+			continue
+		}
+
+		notify, highlight, err := evaluatePushRules(rules, event, len(members))
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("notificationdata consumer: failed to evaluate push rules")
+			continue
+		}
+		if !notify {
+			continue
+		}
+
+		if err = c.db.NotificationDataTable().IncrementCounts(ctx, nil, userID, event.RoomID(), pos, highlight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processReceipt resets the read user's notification/highlight counts for
+// the room the receipt was sent in.
+func (c *NotificationDataConsumer) processReceipt(ctx context.Context, event gomatrixserverlib.HeaderedEvent) error {
+	var content map[string]map[string]map[string]struct {
+		UserID string `json:"-"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return nil // malformed receipt, nothing we can do
+	}
+
+	for _, receiptTypes := range content {
+		for receiptType, users := range receiptTypes {
+			if receiptType != "m.read" && receiptType != "m.fully_read" {
+				continue
+			}
+			for userID := range users {
+				if err := c.db.NotificationDataTable().ResetCounts(ctx, nil, userID, event.RoomID()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// evaluatePushRules decides whether event should notify and/or highlight
+// for a user holding rules, given the room's current member count (some
+// built-in rules, e.g. the two-member "DM" rule, depend on it).
+func evaluatePushRules(
+	rules *pushrules.AccountRuleSet, event gomatrixserverlib.HeaderedEvent, roomMemberCount int,
+) (notify, highlight bool, err error) {
+	evaluator := pushrules.NewEvaluator(rules)
+	rule, err := evaluator.MatchEvent(event, roomMemberCount)
+	if err != nil || rule == nil {
+		return false, false, err
+	}
+	for _, action := range rule.Actions {
+		switch action.Kind {
+		case pushrules.NotifyAction:
+			notify = true
+		case pushrules.SetTweakAction:
+			if action.Tweak == pushrules.HighlightTweak {
+				highlight = true
+			}
+		}
+	}
+	return notify, highlight, nil
+}
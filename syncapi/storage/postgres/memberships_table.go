@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -30,6 +31,14 @@ import (
 // most recent time that a user was invited to, joined or left
 // a room, either by choice or otherwise. This is important for
 // building history visibility.
+//
+// Unlike a plain "one row per (room, user, membership)" table, each row here
+// covers a span of stream positions during which that membership held, with
+// stream_pos_end/topological_pos_end left NULL while the membership is still
+// current. This lets SelectMembershipRanges reconstruct, for an arbitrary
+// user, every interval during which they were joined or invited to a room -
+// which is exactly what history visibility needs to decide whether they may
+// see a given event.
 
 const membershipsSchema = `
 CREATE TABLE IF NOT EXISTS syncapi_memberships (
@@ -41,20 +50,46 @@ CREATE TABLE IF NOT EXISTS syncapi_memberships (
 	membership TEXT NOT NULL,
 	-- The event ID that last changed the membership
 	event_id TEXT NOT NULL,
-	-- The stream position of the change
+	-- The stream position this membership span began at
 	stream_pos BIGINT NOT NULL,
-	-- The topological position of the change in the room
+	-- The topological position this membership span began at
 	topological_pos BIGINT NOT NULL,
-	-- Unique index
-	CONSTRAINT syncapi_memberships_unique UNIQUE (room_id, user_id, membership)
+	-- The stream position this membership span ended at, or NULL if it is
+	-- still the user's current membership in the room
+	stream_pos_end BIGINT,
+	-- The topological position this membership span ended at, or NULL if it
+	-- is still the user's current membership in the room
+	topological_pos_end BIGINT
 );
 `
 
-const upsertMembershipSQL = "" +
+// membershipsSchemaMigration upgrades a syncapi_memberships table created by
+// an older version of this schema, which had no stream_pos_end/
+// topological_pos_end columns and instead enforced uniqueness with
+// syncapi_memberships_unique UNIQUE (room_id, user_id, membership). It must
+// run before membershipsOpenIndexSchema, which assumes stream_pos_end
+// already exists. CREATE TABLE IF NOT EXISTS is a no-op on a table that
+// already exists, so without this the index creation below would fail
+// outright on any deployment upgrading from that schema.
+const membershipsSchemaMigration = `
+ALTER TABLE syncapi_memberships ADD COLUMN IF NOT EXISTS stream_pos_end BIGINT;
+ALTER TABLE syncapi_memberships ADD COLUMN IF NOT EXISTS topological_pos_end BIGINT;
+ALTER TABLE syncapi_memberships DROP CONSTRAINT IF EXISTS syncapi_memberships_unique;
+`
+
+const membershipsOpenIndexSchema = `
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_memberships_open_idx
+    ON syncapi_memberships (room_id, user_id)
+    WHERE stream_pos_end IS NULL;
+`
+
+const closeOpenMembershipSQL = "" +
+	"UPDATE syncapi_memberships SET stream_pos_end = $3, topological_pos_end = $4" +
+	" WHERE room_id = $1 AND user_id = $2 AND stream_pos_end IS NULL"
+
+const insertMembershipSQL = "" +
 	"INSERT INTO syncapi_memberships (room_id, user_id, membership, event_id, stream_pos, topological_pos)" +
-	" VALUES ($1, $2, $3, $4, $5, $6)" +
-	" ON CONFLICT ON CONSTRAINT syncapi_memberships_unique" +
-	" DO UPDATE SET event_id = $4, stream_pos = $5, topological_pos = $6"
+	" VALUES ($1, $2, $3, $4, $5, $6)"
 
 const selectMembershipSQL = "" +
 	"SELECT event_id, stream_pos, topological_pos FROM syncapi_memberships" +
@@ -62,12 +97,23 @@ const selectMembershipSQL = "" +
 	" ORDER BY stream_pos DESC" +
 	" LIMIT 1"
 
+const selectMembershipRangesSQL = "" +
+	"SELECT membership, stream_pos, topological_pos, stream_pos_end FROM syncapi_memberships" +
+	" WHERE room_id = $1 AND user_id = $2" +
+	" ORDER BY stream_pos ASC"
+
+const selectMaxStreamPosForRoomSQL = "" +
+	"SELECT COALESCE(MAX(id), 0) FROM syncapi_output_room_events WHERE room_id = $1"
+
 const purgeMembershipForRoomSQL = "DELETE FROM syncapi_memberships WHERE room_id = $1"
 
 type membershipsStatements struct {
-	upsertMembershipStmt       *sql.Stmt
-	selectMembershipStmt       *sql.Stmt
-	purgeMembershipForRoomStmt *sql.Stmt
+	closeOpenMembershipStmt       *sql.Stmt
+	insertMembershipStmt          *sql.Stmt
+	selectMembershipStmt          *sql.Stmt
+	selectMembershipRangesStmt    *sql.Stmt
+	selectMaxStreamPosForRoomStmt *sql.Stmt
+	purgeMembershipForRoomStmt    *sql.Stmt
 }
 
 func NewPostgresMembershipsTable(db *sql.DB) (tables.Memberships, error) {
@@ -76,12 +122,27 @@ func NewPostgresMembershipsTable(db *sql.DB) (tables.Memberships, error) {
 	if err != nil {
 		return nil, err
 	}
-	if s.upsertMembershipStmt, err = db.Prepare(upsertMembershipSQL); err != nil {
+	if _, err = db.Exec(membershipsSchemaMigration); err != nil {
+		return nil, fmt.Errorf("membershipsSchemaMigration: %w", err)
+	}
+	if _, err = db.Exec(membershipsOpenIndexSchema); err != nil {
+		return nil, fmt.Errorf("membershipsOpenIndexSchema: %w", err)
+	}
+	if s.closeOpenMembershipStmt, err = db.Prepare(closeOpenMembershipSQL); err != nil {
+		return nil, err
+	}
+	if s.insertMembershipStmt, err = db.Prepare(insertMembershipSQL); err != nil {
 		return nil, err
 	}
 	if s.selectMembershipStmt, err = db.Prepare(selectMembershipSQL); err != nil {
 		return nil, err
 	}
+	if s.selectMembershipRangesStmt, err = db.Prepare(selectMembershipRangesSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxStreamPosForRoomStmt, err = db.Prepare(selectMaxStreamPosForRoomSQL); err != nil {
+		return nil, err
+	}
 	if s.purgeMembershipForRoomStmt, err = db.Prepare(purgeMembershipForRoomSQL); err != nil {
 		return nil, err
 	}
@@ -96,14 +157,21 @@ func (s *membershipsStatements) UpsertMembership(
 	if err != nil {
 		return fmt.Errorf("event.Membership: %w", err)
 	}
-	_, err = sqlutil.TxStmt(txn, s.upsertMembershipStmt).ExecContext(
-		ctx,
-		event.RoomID(),
-		*event.StateKey(),
-		membership,
-		event.EventID(),
-		streamPos,
-		topologicalPos,
+
+	roomID := event.RoomID()
+	userID := *event.StateKey()
+
+	// Close out whichever membership span was open for this user in this
+	// room, if any, before opening the new one.
+	_, err = sqlutil.TxStmt(txn, s.closeOpenMembershipStmt).ExecContext(
+		ctx, roomID, userID, streamPos, topologicalPos,
+	)
+	if err != nil {
+		return fmt.Errorf("closeOpenMembershipStmt: %w", err)
+	}
+
+	_, err = sqlutil.TxStmt(txn, s.insertMembershipStmt).ExecContext(
+		ctx, roomID, userID, membership, event.EventID(), streamPos, topologicalPos,
 	)
 	return err
 }
@@ -116,6 +184,42 @@ func (s *membershipsStatements) SelectMembership(
 	return
 }
 
+// SelectMembershipRanges returns the ordered list of membership spans for
+// userID in roomID, each carrying the stream/topological position the span
+// started at and the stream position it ended at. A span that is still the
+// user's current membership ends at the room's most recent stream position.
+func (s *membershipsStatements) SelectMembershipRanges(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) ([]tables.MembershipRange, error) {
+	var currentPos types.StreamPosition
+	err := sqlutil.TxStmt(txn, s.selectMaxStreamPosForRoomStmt).QueryRowContext(ctx, roomID).Scan(&currentPos)
+	if err != nil {
+		return nil, fmt.Errorf("selectMaxStreamPosForRoomStmt: %w", err)
+	}
+
+	rows, err := sqlutil.TxStmt(txn, s.selectMembershipRangesStmt).QueryContext(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMembershipRanges: rows.close() failed")
+
+	var ranges []tables.MembershipRange
+	for rows.Next() {
+		var r tables.MembershipRange
+		var streamPosEnd sql.NullInt64
+		if err = rows.Scan(&r.Membership, &r.FromStreamPos, &r.FromTopologicalPos, &streamPosEnd); err != nil {
+			return nil, err
+		}
+		if streamPosEnd.Valid {
+			r.ToStreamPos = types.StreamPosition(streamPosEnd.Int64)
+		} else {
+			r.ToStreamPos = currentPos
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
+
 func (s *membershipsStatements) PurgeRoom(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) error {
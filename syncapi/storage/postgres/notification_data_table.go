@@ -0,0 +1,64 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/shared"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+const notificationDataSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_notification_data (
+	id BIGSERIAL PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	notification_count BIGINT NOT NULL DEFAULT 0,
+	highlight_count BIGINT NOT NULL DEFAULT 0,
+	last_stream_pos BIGINT NOT NULL DEFAULT 0,
+	CONSTRAINT syncapi_notifications_unique UNIQUE (user_id, room_id)
+);`
+
+const upsertNotificationDataSQL = "" +
+	"INSERT INTO syncapi_notification_data (user_id, room_id, notification_count, highlight_count, last_stream_pos)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_notifications_unique" +
+	" DO UPDATE SET notification_count = $3, highlight_count = $4, last_stream_pos = $5" +
+	" WHERE syncapi_notification_data.last_stream_pos < $5"
+
+// incrementNotificationDataSQL increments the existing counters instead of
+// overwriting them, so that evaluating push rules for one event never wipes
+// out an increment from another event the consumer is processing
+// concurrently. The WHERE clause makes it safe to replay: an update whose
+// stream position has already been applied is a no-op rather than a double
+// increment.
+const incrementNotificationDataSQL = "" +
+	"INSERT INTO syncapi_notification_data (user_id, room_id, notification_count, highlight_count, last_stream_pos)" +
+	" VALUES ($1, $2, 1, $4, $3)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_notifications_unique" +
+	" DO UPDATE SET" +
+	" notification_count = syncapi_notification_data.notification_count + 1," +
+	" highlight_count = syncapi_notification_data.highlight_count + $4," +
+	" last_stream_pos = $3" +
+	" WHERE syncapi_notification_data.last_stream_pos < $3"
+
+func NewPostgresNotificationDataTable(db *sql.DB) (tables.NotificationData, error) {
+	_, err := db.Exec(notificationDataSchema)
+	if err != nil {
+		return nil, err
+	}
+	return shared.NewNotificationDataTable(db, upsertNotificationDataSQL, incrementNotificationDataSQL)
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// notificationDataSchema differs between postgres and sqlite only in its
+// primary key type; the CREATE TABLE lives in each backend's package (to keep their migrations
+// independent) while the statements themselves live here. The upsert and
+// increment statements are the exception: their ON CONFLICT clause is not
+// portable SQL (postgres needs ON CONFLICT ON CONSTRAINT, sqlite needs
+// ON CONFLICT(cols)), so each backend supplies its own and passes them into
+// NewNotificationDataTable.
+
+const resetNotificationDataSQL = "" +
+	"UPDATE syncapi_notification_data SET notification_count = 0, highlight_count = 0" +
+	" WHERE user_id = $1 AND room_id = $2"
+
+const selectCountsSinceSQL = "" +
+	"SELECT room_id, notification_count, highlight_count FROM syncapi_notification_data" +
+	" WHERE user_id = $1 AND last_stream_pos > $2"
+
+type notificationDataStatements struct {
+	upsertNotificationDataStmt    *sql.Stmt
+	incrementNotificationDataStmt *sql.Stmt
+	resetNotificationDataStmt     *sql.Stmt
+	selectCountsSinceStmt         *sql.Stmt
+}
+
+// NewNotificationDataTable prepares the statements shared by the postgres
+// and sqlite backends. Each backend is responsible for creating the table
+// itself (the schema differs only in the primary key type) and for
+// supplying upsertSQL/incrementSQL in its own ON CONFLICT dialect before
+// calling this.
+func NewNotificationDataTable(db *sql.DB, upsertSQL, incrementSQL string) (tables.NotificationData, error) {
+	s := &notificationDataStatements{}
+	var err error
+	if s.upsertNotificationDataStmt, err = db.Prepare(upsertSQL); err != nil {
+		return nil, err
+	}
+	if s.incrementNotificationDataStmt, err = db.Prepare(incrementSQL); err != nil {
+		return nil, err
+	}
+	if s.resetNotificationDataStmt, err = db.Prepare(resetNotificationDataSQL); err != nil {
+		return nil, err
+	}
+	if s.selectCountsSinceStmt, err = db.Prepare(selectCountsSinceSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// UpsertCounts records the current notification/highlight counts for
+// (userID, roomID). pos is the stream position of the event that produced
+// this update; if a later update for the same (userID, roomID) has already
+// been applied (last_stream_pos >= pos), this is a no-op, which is what
+// makes the push-rule consumer safe to replay after a restart.
+func (s *notificationDataStatements) UpsertCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition,
+	notificationCount, highlightCount int,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertNotificationDataStmt).ExecContext(
+		ctx, userID, roomID, notificationCount, highlightCount, pos,
+	)
+	return err
+}
+
+// IncrementCounts adds one to notification_count, and one to highlight_count
+// if highlight is set, for (userID, roomID). pos is the stream position of
+// the event that earned the increment; an event whose position has already
+// been applied (last_stream_pos >= pos) is skipped, which is what makes the
+// push-rule consumer safe to replay after a restart.
+func (s *notificationDataStatements) IncrementCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition, highlight bool,
+) error {
+	highlightDelta := 0
+	if highlight {
+		highlightDelta = 1
+	}
+	_, err := sqlutil.TxStmt(txn, s.incrementNotificationDataStmt).ExecContext(
+		ctx, userID, roomID, pos, highlightDelta,
+	)
+	return err
+}
+
+// ResetCounts zeroes notification_count and highlight_count for
+// (userID, roomID). It is called when userID sends an m.read or
+// m.fully_read receipt for roomID.
+func (s *notificationDataStatements) ResetCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.resetNotificationDataStmt).ExecContext(ctx, userID, roomID)
+	return err
+}
+
+// SelectCountsSince returns the notification/highlight counts for every
+// room of userID that has changed since sincePos, keyed by room ID. Rooms
+// with no change since sincePos are omitted so that an incremental /sync
+// response doesn't have to carry every joined room's counts every time.
+func (s *notificationDataStatements) SelectCountsSince(
+	ctx context.Context, txn *sql.Tx, userID string, sincePos types.StreamPosition,
+) (map[string]*tables.NotificationCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectCountsSinceStmt).QueryContext(ctx, userID, sincePos)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectCountsSince: rows.close() failed")
+
+	counts := make(map[string]*tables.NotificationCounts)
+	for rows.Next() {
+		var roomID string
+		var data tables.NotificationCounts
+		if err = rows.Scan(&roomID, &data.NotificationCount, &data.HighlightCount); err != nil {
+			return nil, err
+		}
+		counts[roomID] = &data
+	}
+	return counts, rows.Err()
+}
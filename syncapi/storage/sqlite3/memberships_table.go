@@ -0,0 +1,195 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// See the postgres implementation for the rationale behind storing each
+// membership as a span of stream positions rather than one row per
+// membership value.
+
+const membershipsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_memberships (
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	membership TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	stream_pos BIGINT NOT NULL,
+	topological_pos BIGINT NOT NULL,
+	stream_pos_end BIGINT,
+	topological_pos_end BIGINT
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS syncapi_memberships_open_idx
+    ON syncapi_memberships (room_id, user_id)
+    WHERE stream_pos_end IS NULL;
+`
+
+const closeOpenMembershipSQL = "" +
+	"UPDATE syncapi_memberships SET stream_pos_end = $3, topological_pos_end = $4" +
+	" WHERE room_id = $1 AND user_id = $2 AND stream_pos_end IS NULL"
+
+const insertMembershipSQL = "" +
+	"INSERT INTO syncapi_memberships (room_id, user_id, membership, event_id, stream_pos, topological_pos)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectMembershipSQL = "" +
+	"SELECT event_id, stream_pos, topological_pos FROM syncapi_memberships" +
+	" WHERE room_id = $1 AND user_id = $2 AND membership IN (%s)" +
+	" ORDER BY stream_pos DESC" +
+	" LIMIT 1"
+
+const selectMembershipRangesSQL = "" +
+	"SELECT membership, stream_pos, topological_pos, stream_pos_end FROM syncapi_memberships" +
+	" WHERE room_id = $1 AND user_id = $2" +
+	" ORDER BY stream_pos ASC"
+
+const selectMaxStreamPosForRoomSQL = "" +
+	"SELECT COALESCE(MAX(id), 0) FROM syncapi_output_room_events WHERE room_id = $1"
+
+const purgeMembershipForRoomSQL = "DELETE FROM syncapi_memberships WHERE room_id = $1"
+
+type membershipsStatements struct {
+	db                            *sql.DB
+	closeOpenMembershipStmt       *sql.Stmt
+	insertMembershipStmt          *sql.Stmt
+	selectMembershipRangesStmt    *sql.Stmt
+	selectMaxStreamPosForRoomStmt *sql.Stmt
+	purgeMembershipForRoomStmt    *sql.Stmt
+}
+
+func NewSqliteMembershipsTable(db *sql.DB) (tables.Memberships, error) {
+	s := &membershipsStatements{db: db}
+	_, err := db.Exec(membershipsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.closeOpenMembershipStmt, err = db.Prepare(closeOpenMembershipSQL); err != nil {
+		return nil, err
+	}
+	if s.insertMembershipStmt, err = db.Prepare(insertMembershipSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMembershipRangesStmt, err = db.Prepare(selectMembershipRangesSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxStreamPosForRoomStmt, err = db.Prepare(selectMaxStreamPosForRoomSQL); err != nil {
+		return nil, err
+	}
+	if s.purgeMembershipForRoomStmt, err = db.Prepare(purgeMembershipForRoomSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *membershipsStatements) UpsertMembership(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+	streamPos, topologicalPos types.StreamPosition,
+) error {
+	membership, err := event.Membership()
+	if err != nil {
+		return fmt.Errorf("event.Membership: %w", err)
+	}
+
+	roomID := event.RoomID()
+	userID := *event.StateKey()
+
+	_, err = sqlutil.TxStmt(txn, s.closeOpenMembershipStmt).ExecContext(
+		ctx, roomID, userID, streamPos, topologicalPos,
+	)
+	if err != nil {
+		return fmt.Errorf("closeOpenMembershipStmt: %w", err)
+	}
+
+	_, err = sqlutil.TxStmt(txn, s.insertMembershipStmt).ExecContext(
+		ctx, roomID, userID, membership, event.EventID(), streamPos, topologicalPos,
+	)
+	return err
+}
+
+// SelectMembership looks up the most recent row matching one of memberships.
+// The IN clause is built per-call (rather than prepared once) because SQLite
+// has no array bind parameter to hold memberships.
+func (s *membershipsStatements) SelectMembership(
+	ctx context.Context, txn *sql.Tx, roomID, userID, memberships []string,
+) (eventID string, streamPos, topologyPos types.StreamPosition, err error) {
+	query := fmt.Sprintf(selectMembershipSQL, sqlutil.QueryVariadic(len(memberships)))
+	args := make([]interface{}, 0, len(memberships)+2)
+	args = append(args, roomID, userID)
+	for _, m := range memberships {
+		args = append(args, m)
+	}
+
+	var row *sql.Row
+	if txn != nil {
+		row = txn.QueryRowContext(ctx, query, args...)
+	} else {
+		row = s.db.QueryRowContext(ctx, query, args...)
+	}
+	err = row.Scan(&eventID, &streamPos, &topologyPos)
+	return
+}
+
+// SelectMembershipRanges returns the ordered list of membership spans for
+// userID in roomID. See the postgres implementation for details.
+func (s *membershipsStatements) SelectMembershipRanges(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+) ([]tables.MembershipRange, error) {
+	var currentPos types.StreamPosition
+	err := sqlutil.TxStmt(txn, s.selectMaxStreamPosForRoomStmt).QueryRowContext(ctx, roomID).Scan(&currentPos)
+	if err != nil {
+		return nil, fmt.Errorf("selectMaxStreamPosForRoomStmt: %w", err)
+	}
+
+	rows, err := sqlutil.TxStmt(txn, s.selectMembershipRangesStmt).QueryContext(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMembershipRanges: rows.close() failed")
+
+	var ranges []tables.MembershipRange
+	for rows.Next() {
+		var r tables.MembershipRange
+		var streamPosEnd sql.NullInt64
+		if err = rows.Scan(&r.Membership, &r.FromStreamPos, &r.FromTopologicalPos, &streamPosEnd); err != nil {
+			return nil, err
+		}
+		if streamPosEnd.Valid {
+			r.ToStreamPos = types.StreamPosition(streamPosEnd.Int64)
+		} else {
+			r.ToStreamPos = currentPos
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
+
+func (s *membershipsStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.purgeMembershipForRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
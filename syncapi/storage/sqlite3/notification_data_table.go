@@ -28,13 +28,37 @@ CREATE TABLE IF NOT EXISTS syncapi_notification_data (
 	room_id TEXT NOT NULL,
 	notification_count BIGINT NOT NULL DEFAULT 0,
 	highlight_count BIGINT NOT NULL DEFAULT 0,
+	last_stream_pos BIGINT NOT NULL DEFAULT 0,
 	CONSTRAINT syncapi_notifications_unique UNIQUE (user_id, room_id)
 );`
 
+const upsertNotificationDataSQL = "" +
+	"INSERT INTO syncapi_notification_data (user_id, room_id, notification_count, highlight_count, last_stream_pos)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT(user_id, room_id)" +
+	" DO UPDATE SET notification_count = $3, highlight_count = $4, last_stream_pos = $5" +
+	" WHERE syncapi_notification_data.last_stream_pos < $5"
+
+// incrementNotificationDataSQL increments the existing counters instead of
+// overwriting them, so that evaluating push rules for one event never wipes
+// out an increment from another event the consumer is processing
+// concurrently. The WHERE clause makes it safe to replay: an update whose
+// stream position has already been applied is a no-op rather than a double
+// increment.
+const incrementNotificationDataSQL = "" +
+	"INSERT INTO syncapi_notification_data (user_id, room_id, notification_count, highlight_count, last_stream_pos)" +
+	" VALUES ($1, $2, 1, $4, $3)" +
+	" ON CONFLICT(user_id, room_id)" +
+	" DO UPDATE SET" +
+	" notification_count = syncapi_notification_data.notification_count + 1," +
+	" highlight_count = syncapi_notification_data.highlight_count + $4," +
+	" last_stream_pos = $3" +
+	" WHERE syncapi_notification_data.last_stream_pos < $3"
+
 func NewSqliteNotificationDataTable(db *sql.DB) (tables.NotificationData, error) {
 	_, err := db.Exec(notificationDataSchema)
 	if err != nil {
 		return nil, err
 	}
-	return shared.NewNotificationDataTable(db)
+	return shared.NewNotificationDataTable(db, upsertNotificationDataSQL, incrementNotificationDataSQL)
 }
\ No newline at end of file
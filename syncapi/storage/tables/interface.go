@@ -0,0 +1,79 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tables declares the interfaces the postgres and sqlite backends
+// both implement, so the rest of syncapi can depend on a single backend-
+// agnostic type per table.
+package tables
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Memberships tracks, for every (room, user), the membership value that
+// held over each span of stream positions.
+type Memberships interface {
+	// UpsertMembership records that event changed the membership of
+	// *event.StateKey() in event.RoomID() to event.Membership(), closing
+	// out whichever span was previously open for that user and room.
+	UpsertMembership(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, streamPos, topologicalPos types.StreamPosition) error
+	// SelectMembership returns the most recent row for userID in roomID
+	// whose membership is one of memberships.
+	SelectMembership(ctx context.Context, txn *sql.Tx, roomID, userID, memberships []string) (eventID string, streamPos, topologyPos types.StreamPosition, err error)
+	// SelectMembershipRanges returns every membership span recorded for
+	// userID in roomID, in stream order, with spans still open reported as
+	// ending at the room's current stream position.
+	SelectMembershipRanges(ctx context.Context, txn *sql.Tx, roomID, userID string) ([]MembershipRange, error)
+	// PurgeRoom deletes every row for roomID.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+// MembershipRange is one span of stream/topological positions during which
+// a user held a single membership value in a room.
+type MembershipRange struct {
+	Membership         string
+	FromStreamPos      types.StreamPosition
+	FromTopologicalPos types.StreamPosition
+	ToStreamPos        types.StreamPosition
+}
+
+// NotificationData tracks, for every (room, user), the notification and
+// highlight counts produced by evaluating push rules against that user's
+// timeline events.
+type NotificationData interface {
+	// UpsertCounts sets the notification/highlight counts for (userID,
+	// roomID) outright, guarded by pos so a replayed update can never go
+	// backwards.
+	UpsertCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition, notificationCount, highlightCount int) error
+	// IncrementCounts adds one to the notification count, and to the
+	// highlight count if highlight is set, for (userID, roomID).
+	IncrementCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition, highlight bool) error
+	// ResetCounts zeroes the counts for (userID, roomID), used when userID
+	// reads roomID.
+	ResetCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) error
+	// SelectCountsSince returns the counts for every room of userID that
+	// has changed since sincePos, keyed by room ID.
+	SelectCountsSince(ctx context.Context, txn *sql.Tx, userID string, sincePos types.StreamPosition) (map[string]*NotificationCounts, error)
+}
+
+// NotificationCounts is the notification/highlight count pair surfaced to a
+// client as unread_notifications in a /sync response.
+type NotificationCounts struct {
+	NotificationCount int
+	HighlightCount    int
+}
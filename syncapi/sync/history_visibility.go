@@ -0,0 +1,63 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// filterHistoryVisibleEvents drops any event in events whose stream position
+// does not fall inside a join or invite span for userID, which is the rule
+// of the "joined" and "invited" m.room.history_visibility settings. The
+// room's own history_visibility setting is not read: every room is filtered
+// this way. It is applied to timeline and backfill pages just before they
+// are returned to the client.
+func filterHistoryVisibleEvents(
+	ctx context.Context, memberships tables.Memberships, txn *sql.Tx,
+	roomID, userID string, events []types.StreamEvent,
+) ([]types.StreamEvent, error) {
+	ranges, err := memberships.SelectMembershipRanges(ctx, txn, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make([]types.StreamEvent, 0, len(events))
+	for _, event := range events {
+		if isVisibleAt(ranges, event.StreamPosition) {
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+// isVisibleAt reports whether pos falls inside a join or invite span in
+// ranges. Other membership states (leave, ban, knock) never grant
+// visibility.
+func isVisibleAt(ranges []tables.MembershipRange, pos types.StreamPosition) bool {
+	for _, r := range ranges {
+		if r.Membership != gomatrixserverlib.Join && r.Membership != gomatrixserverlib.Invite {
+			continue
+		}
+		if pos >= r.FromStreamPos && pos <= r.ToStreamPos {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestIsVisibleAt(t *testing.T) {
+	ranges := []tables.MembershipRange{
+		{Membership: gomatrixserverlib.Invite, FromStreamPos: 1, ToStreamPos: 4},
+		{Membership: gomatrixserverlib.Leave, FromStreamPos: 5, ToStreamPos: 9},
+		{Membership: gomatrixserverlib.Join, FromStreamPos: 10, ToStreamPos: 20},
+	}
+
+	cases := []struct {
+		name string
+		pos  types.StreamPosition
+		want bool
+	}{
+		{"inside invite span", 2, true},
+		{"invite span boundary", 4, true},
+		{"inside leave span", 7, false},
+		{"inside join span", 15, true},
+		{"after every span", 25, false},
+		{"before every span", 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isVisibleAt(ranges, c.pos); got != c.want {
+				t.Errorf("isVisibleAt(%d) = %v, want %v", c.pos, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// BuildTimeline fetches the events for roomID between from and to (used for
+// both incremental /sync pages and /messages backfill) and applies history
+// visibility before returning them, so a caller never has to remember to
+// filter it in themselves.
+func BuildTimeline(
+	ctx context.Context, db storage.Database, txn *sql.Tx,
+	roomID, userID string, from, to types.StreamPosition, limit int,
+) ([]types.StreamEvent, error) {
+	events, err := db.RecentEvents(ctx, txn, roomID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return filterHistoryVisibleEvents(ctx, db.MembershipsTable(), txn, roomID, userID, events)
+}
+
+// PopulateJoinedRooms fills in the timeline for each of userID's joined
+// rooms in res.Rooms.Join (which the caller has already created one entry
+// for per joined room), then stamps the unread_notifications block of each
+// of those rooms whose counts changed since from. It is the last step of
+// building a /sync response, once every joined room is known.
+func PopulateJoinedRooms(
+	ctx context.Context, db storage.Database, txn *sql.Tx,
+	userID string, from, to types.StreamPosition, limit int,
+	res *types.Response,
+) error {
+	for roomID, jr := range res.Rooms.Join {
+		events, err := BuildTimeline(ctx, db, txn, roomID, userID, from, to, limit)
+		if err != nil {
+			return err
+		}
+		jr.Timeline.Events = events
+		res.Rooms.Join[roomID] = jr
+	}
+
+	return addUnreadNotifications(ctx, db.NotificationDataTable(), txn, userID, from, res)
+}
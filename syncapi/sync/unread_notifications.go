@@ -0,0 +1,49 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// addUnreadNotifications populates the unread_notifications block of each
+// joined room in res with the counts accumulated since since, leaving rooms
+// that haven't changed untouched so they keep whatever was already set.
+func addUnreadNotifications(
+	ctx context.Context, notificationData tables.NotificationData, txn *sql.Tx,
+	userID string, since types.StreamPosition, res *types.Response,
+) error {
+	counts, err := notificationData.SelectCountsSince(ctx, txn, userID, since)
+	if err != nil {
+		return err
+	}
+
+	for roomID, count := range counts {
+		jr, ok := res.Rooms.Join[roomID]
+		if !ok {
+			continue
+		}
+		jr.UnreadNotifications = types.UnreadNotifications{
+			NotificationCount: count.NotificationCount,
+			HighlightCount:    count.HighlightCount,
+		}
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}